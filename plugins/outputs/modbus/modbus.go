@@ -1,32 +1,169 @@
 package modbus
 
 import (
+	"encoding/binary"
 	"fmt"
-	"hash/fnv"
-	"net"
+	"math"
 	"sync"
 
 	"github.com/goburrow/modbus"
 	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/config"
+	tlsint "github.com/influxdata/telegraf/plugins/common/tls"
 	"github.com/influxdata/telegraf/plugins/outputs"
 )
 
+// Supported register_type values.
+const (
+	registerTypeCoil            = "coil"
+	registerTypeDiscreteInput   = "discrete_input"
+	registerTypeInputRegister   = "input_register"
+	registerTypeHoldingRegister = "holding_register"
+)
+
+// registerWidths gives the number of consecutive 16-bit registers a
+// data_type occupies. BOOL is only valid for coil/discrete_input and does
+// not consume a 16-bit register slot.
+var registerWidths = map[string]uint16{
+	"BOOL":    0,
+	"INT16":   1,
+	"UINT16":  1,
+	"INT32":   2,
+	"UINT32":  2,
+	"FLOAT32": 2,
+	"INT64":   4,
+	"UINT64":  4,
+	"FLOAT64": 4,
+}
+
+var validByteOrders = map[string]bool{
+	"ABCD": true,
+	"DCBA": true,
+	"BADC": true,
+	"CDAB": true,
+}
+
+// RegisterMapping binds a single metric field to a fixed location in the
+// Modbus address space this output serves.
+type RegisterMapping struct {
+	Metric       string  `toml:"metric"`
+	Field        string  `toml:"field"`
+	RegisterType string  `toml:"register_type"`
+	Address      uint16  `toml:"address"`
+	DataType     string  `toml:"data_type"`
+	ByteOrder    string  `toml:"byte_order"`
+	Scale        float64 `toml:"scale"`
+	Offset       float64 `toml:"offset"`
+}
+
+// resolvedMapping is a RegisterMapping after validation, with derived and
+// defaulted fields filled in so Write doesn't re-derive them on every call.
+type resolvedMapping struct {
+	registerType string
+	address      uint16
+	dataType     string
+	byteOrder    string
+	scale        float64
+	offset       float64
+	registers    uint16
+}
+
 type Modbus struct {
-	Address string `toml:"address"`
+	Address  string            `toml:"address"`
+	Mappings []RegisterMapping `toml:"mapping"`
 
-	server *modbus.TCPServer
-	mu     sync.Mutex
+	// Transport selects how the server is exposed: tcp (default), tcp+tls,
+	// or rtu. TLS fields come from the embedded ServerConfig; serial fields
+	// below only apply to rtu.
+	Transport string `toml:"transport"`
+	tlsint.ServerConfig
+
+	SerialDevice string `toml:"serial_device"`
+	BaudRate     int    `toml:"baud_rate"`
+	DataBits     int    `toml:"data_bits"`
+	Parity       string `toml:"parity"`
+	StopBits     int    `toml:"stop_bits"`
+
+	// UnitID is the slave ID this server answers as. 0 answers any unit,
+	// matching the plugin's original behavior.
+	UnitID byte `toml:"unit_id"`
+
+	// OnWrite, if set, is invoked after every client-originated coil or
+	// register write (FC5, FC6, FC15, FC16) is applied to the in-memory
+	// map, letting a downstream processor/aggregator or companion input
+	// plugin observe SCADA-initiated writes as new metrics.
+	OnWrite func(registerType string, address uint16, values []uint16) `toml:"-"`
+
+	server     *modbus.TCPServer
+	rtuHandler *modbus.RTUHandler
+	mu         sync.Mutex
 
 	coils            map[uint16]bool
 	discreteInputs   map[uint16]bool
 	inputRegisters   map[uint16]uint16
 	holdingRegisters map[uint16]uint16
+
+	// fieldMappings is keyed by "<metric>_<field>" for O(1) lookup in Write.
+	fieldMappings map[string]resolvedMapping
+
+	Upstreams     []*Upstream     `toml:"upstream"`
+	ProxyCacheTTL config.Duration `toml:"proxy_cache_ttl"`
+
+	proxyCache   map[string]proxyCacheEntry
+	proxyCacheMu sync.Mutex
 }
 
 func (m *Modbus) SampleConfig() string {
 	return `
   ## Address of the Modbus server
   address = "0.0.0.0:502"
+
+  ## Transport to serve over: "tcp" (default), "tcp+tls", or "rtu".
+  # transport = "tcp"
+
+  ## TLS config, only used when transport = "tcp+tls".
+  # tls_cert = "/etc/telegraf/cert.pem"
+  # tls_key = "/etc/telegraf/key.pem"
+  # tls_allowed_cacerts = ["/etc/telegraf/ca.pem"]
+
+  ## Serial port settings, only used when transport = "rtu".
+  # serial_device = "/dev/ttyUSB0"
+  # baud_rate = 9600
+  # data_bits = 8
+  # parity = "N"
+  # stop_bits = 1
+
+  ## Slave ID this server answers as. Requests for any other unit ID get an
+  ## illegal-address exception. 0 (default) answers every unit.
+  # unit_id = 1
+
+  ## Explicit register map. Every metric field that should be exposed over
+  ## Modbus needs one [[outputs.modbus.mapping]] entry.
+  # [[outputs.modbus.mapping]]
+  #   metric = "power"
+  #   field = "voltage"
+  #   register_type = "holding_register"  ## coil, discrete_input, input_register, holding_register
+  #   address = 0
+  #   data_type = "FLOAT32"               ## BOOL, INT16, UINT16, INT32, UINT32, INT64, UINT64, FLOAT32, FLOAT64
+  #   byte_order = "ABCD"                 ## ABCD, DCBA, BADC, CDAB (multi-register types only)
+  #   scale = 1.0
+  #   offset = 0.0
+
+  ## Optionally proxy selected function codes to one or more upstream
+  ## Modbus devices instead of (or in addition to) serving the maps above.
+  ## Requests whose register_type/address fall within address_range are
+  ## forwarded; with no address_range the upstream matches everything.
+  # [[outputs.modbus.upstream]]
+  #   unit_id = 1
+  #   address = "192.168.1.20:502"  ## host:port for TCP, e.g. "/dev/ttyUSB0" for RTU
+  #   timeout = "5s"
+  #   # [[outputs.modbus.upstream.address_range]]
+  #   #   register_type = "holding_register"
+  #   #   start = 0
+  #   #   end = 100
+
+  ## How long a proxied read is cached before being re-fetched upstream.
+  # proxy_cache_ttl = "250ms"
 `
 }
 
@@ -34,33 +171,94 @@ func (m *Modbus) Description() string {
 	return "A Modbus server that outputs Telegraf metrics"
 }
 
-func (m *Modbus) StartServer() {
-	listener, err := net.Listen("tcp", m.Address)
-	if err != nil {
-		fmt.Println("Error starting Modbus server:", err)
-		return
+// buildFieldMappings validates the configured mappings and indexes them by
+// metric+field. It rejects unknown register/data/byte-order types and
+// overlapping address ranges within the same register type.
+func (m *Modbus) buildFieldMappings() error {
+	fieldMappings := make(map[string]resolvedMapping, len(m.Mappings))
+	type span struct {
+		start, end uint32 // [start, end)
 	}
-	defer listener.Close()
+	spans := make(map[string][]span)
 
-	handler := modbus.NewTCPServerHandler(listener)
-	m.server = modbus.NewServer(handler)
-	fmt.Println("Modbus server listening on", m.Address)
+	for _, mapping := range m.Mappings {
+		width, ok := registerWidths[mapping.DataType]
+		if !ok {
+			return fmt.Errorf("mapping %s.%s: unknown data_type %q", mapping.Metric, mapping.Field, mapping.DataType)
+		}
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			fmt.Println("Error accepting connection:", err)
-			continue
+		switch mapping.RegisterType {
+		case registerTypeCoil, registerTypeDiscreteInput:
+			if mapping.DataType != "BOOL" {
+				return fmt.Errorf("mapping %s.%s: register_type %q only supports data_type BOOL", mapping.Metric, mapping.Field, mapping.RegisterType)
+			}
+		case registerTypeInputRegister, registerTypeHoldingRegister:
+			if mapping.DataType == "BOOL" {
+				return fmt.Errorf("mapping %s.%s: register_type %q cannot hold data_type BOOL", mapping.Metric, mapping.Field, mapping.RegisterType)
+			}
+		default:
+			return fmt.Errorf("mapping %s.%s: unknown register_type %q", mapping.Metric, mapping.Field, mapping.RegisterType)
+		}
+
+		byteOrder := mapping.ByteOrder
+		if width > 1 {
+			if byteOrder == "" {
+				byteOrder = "ABCD"
+			}
+			if !validByteOrders[byteOrder] {
+				return fmt.Errorf("mapping %s.%s: unknown byte_order %q", mapping.Metric, mapping.Field, mapping.ByteOrder)
+			}
+		}
+
+		scale := mapping.Scale
+		if scale == 0 {
+			scale = 1
+		}
+
+		length := width
+		if length == 0 {
+			length = 1 // BOOL occupies a single coil/discrete-input slot
+		}
+		end := uint32(mapping.Address) + uint32(length)
+		if end > 0x10000 {
+			return fmt.Errorf("mapping %s.%s: address range overflows 16-bit address space", mapping.Metric, mapping.Field)
+		}
+		for _, s := range spans[mapping.RegisterType] {
+			if uint32(mapping.Address) < s.end && s.start < end {
+				return fmt.Errorf("mapping %s.%s: %s address range [%d,%d) overlaps an existing mapping", mapping.Metric, mapping.Field, mapping.RegisterType, mapping.Address, end)
+			}
+		}
+		spans[mapping.RegisterType] = append(spans[mapping.RegisterType], span{start: uint32(mapping.Address), end: end})
+
+		key := mapping.Metric + "_" + mapping.Field
+		if _, exists := fieldMappings[key]; exists {
+			return fmt.Errorf("mapping %s.%s: duplicate mapping", mapping.Metric, mapping.Field)
+		}
+		fieldMappings[key] = resolvedMapping{
+			registerType: mapping.RegisterType,
+			address:      mapping.Address,
+			dataType:     mapping.DataType,
+			byteOrder:    byteOrder,
+			scale:        scale,
+			offset:       mapping.Offset,
+			registers:    width,
 		}
-		go m.ServeTCP(conn)
 	}
+
+	m.fieldMappings = fieldMappings
+	return nil
 }
 
 func (m *Modbus) Connect() error {
+	if err := m.buildFieldMappings(); err != nil {
+		return err
+	}
+
 	m.coils = make(map[uint16]bool)
 	m.discreteInputs = make(map[uint16]bool)
 	m.inputRegisters = make(map[uint16]uint16)
 	m.holdingRegisters = make(map[uint16]uint16)
+	m.proxyCache = make(map[string]proxyCacheEntry)
 
 	go m.StartServer()
 	return nil
@@ -70,6 +268,12 @@ func (m *Modbus) Close() error {
 	if m.server != nil {
 		m.server.Close()
 	}
+	if m.rtuHandler != nil {
+		m.rtuHandler.Close()
+	}
+	for _, u := range m.Upstreams {
+		u.disconnect()
+	}
 	return nil
 }
 
@@ -77,95 +281,159 @@ func (m *Modbus) Write(metrics []telegraf.Metric) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	var errs []string
 	for _, metric := range metrics {
 		for _, field := range metric.FieldList() {
-			key := fmt.Sprintf("%s_%s", metric.Name(), field.Key)
-			address := hashToUint16(key)
-			value := uint16(field.Value.(float64))
-
-			// Example logic to distribute metrics across different types
-			if address < 10000 {
-				m.coils[address] = value != 0
-			} else if address < 20000 {
-				m.discreteInputs[address-10000] = value != 0
-			} else if address < 30000 {
-				m.inputRegisters[address-20000] = value
-			} else {
-				m.holdingRegisters[address-30000] = value
+			key := metric.Name() + "_" + field.Key
+			mapping, ok := m.fieldMappings[key]
+			if !ok {
+				errs = append(errs, fmt.Sprintf("%s: no register mapping configured", key))
+				continue
+			}
+
+			value, ok := toFloat64(field.Value)
+			if !ok {
+				errs = append(errs, fmt.Sprintf("%s: value %v is not numeric", key, field.Value))
+				continue
+			}
+
+			if err := m.writeMapped(mapping, value); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", key, err))
 			}
 		}
 	}
-	return nil
-}
 
-func hashToUint16(s string) uint16 {
-	h := fnv.New32a()
-	h.Write([]byte(s))
-	return uint16(h.Sum32() % 65536)
+	if len(errs) > 0 {
+		return fmt.Errorf("modbus write errors: %v", errs)
+	}
+	return nil
 }
 
-func (m *Modbus) ServeTCP(conn net.Conn) {
-	handler := modbus.NewTCPHandler()
+// writeMapped encodes value according to mapping and stores it in the
+// appropriate in-memory register map. m.mu must already be held.
+func (m *Modbus) writeMapped(mapping resolvedMapping, value float64) error {
+	raw := value*mapping.scale + mapping.offset
 
-	handler.FuncReadCoils = func(address uint16, quantity uint16) ([]byte, error) {
-		m.mu.Lock()
-		defer m.mu.Unlock()
-		result := make([]byte, quantity/8+1)
-		for i := uint16(0); i < quantity; i++ {
-			if m.coils[address+i] {
-				result[i/8] |= 1 << (i % 8)
-			}
+	if mapping.dataType == "BOOL" {
+		switch mapping.registerType {
+		case registerTypeCoil:
+			m.coils[mapping.address] = raw != 0
+		case registerTypeDiscreteInput:
+			m.discreteInputs[mapping.address] = raw != 0
 		}
-		return result, nil
+		return nil
 	}
 
-	handler.FuncReadDiscreteInputs = func(address uint16, quantity uint16) ([]byte, error) {
-		m.mu.Lock()
-		defer m.mu.Unlock()
-		result := make([]byte, quantity/8+1)
-		for i := uint16(0); i < quantity; i++ {
-			if m.discreteInputs[address+i] {
-				result[i/8] |= 1 << (i % 8)
-			}
-		}
-		return result, nil
+	words, err := encodeRegisters(raw, mapping.dataType, mapping.byteOrder)
+	if err != nil {
+		return err
 	}
 
-	handler.FuncReadHoldingRegisters = func(address uint16, quantity uint16) ([]byte, error) {
-		m.mu.Lock()
-		defer m.mu.Unlock()
-		result := make([]byte, quantity*2)
-		for i := uint16(0); i < quantity; i++ {
-			modbus.Uint16ToBytes(m.holdingRegisters[address+i], result[i*2:])
+	for i, word := range words {
+		switch mapping.registerType {
+		case registerTypeInputRegister:
+			m.inputRegisters[mapping.address+uint16(i)] = word
+		case registerTypeHoldingRegister:
+			m.holdingRegisters[mapping.address+uint16(i)] = word
 		}
-		return result, nil
 	}
+	return nil
+}
 
-	handler.FuncReadInputRegisters = func(address uint16, quantity uint16) ([]byte, error) {
-		m.mu.Lock()
-		defer m.mu.Unlock()
-		result := make([]byte, quantity*2)
-		for i := uint16(0); i < quantity; i++ {
-			modbus.Uint16ToBytes(m.inputRegisters[address+i], result[i*2:])
+// encodeRegisters converts raw into the declared data_type and splits the
+// result into 16-bit registers ordered per byteOrder, mirroring how clients
+// such as goburrow/modbus reassemble multi-register values MSB/LSB first.
+func encodeRegisters(raw float64, dataType, byteOrder string) ([]uint16, error) {
+	var b []byte
+
+	switch dataType {
+	case "INT16":
+		if raw < math.MinInt16 || raw > math.MaxInt16 {
+			return nil, fmt.Errorf("value %v overflows INT16", raw)
+		}
+		b = make([]byte, 2)
+		binary.BigEndian.PutUint16(b, uint16(int16(raw)))
+	case "UINT16":
+		if raw < 0 || raw > math.MaxUint16 {
+			return nil, fmt.Errorf("value %v overflows UINT16", raw)
+		}
+		b = make([]byte, 2)
+		binary.BigEndian.PutUint16(b, uint16(raw))
+	case "INT32":
+		if raw < math.MinInt32 || raw > math.MaxInt32 {
+			return nil, fmt.Errorf("value %v overflows INT32", raw)
+		}
+		b = make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(int32(raw)))
+	case "UINT32":
+		if raw < 0 || raw > math.MaxUint32 {
+			return nil, fmt.Errorf("value %v overflows UINT32", raw)
 		}
-		return result, nil
+		b = make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(raw))
+	case "FLOAT32":
+		if raw < -math.MaxFloat32 || raw > math.MaxFloat32 {
+			return nil, fmt.Errorf("value %v overflows FLOAT32", raw)
+		}
+		b = make([]byte, 4)
+		binary.BigEndian.PutUint32(b, math.Float32bits(float32(raw)))
+	case "INT64":
+		if raw < math.MinInt64 || raw > math.MaxInt64 {
+			return nil, fmt.Errorf("value %v overflows INT64", raw)
+		}
+		b = make([]byte, 8)
+		binary.BigEndian.PutUint64(b, uint64(int64(raw)))
+	case "UINT64":
+		if raw < 0 || raw > math.MaxUint64 {
+			return nil, fmt.Errorf("value %v overflows UINT64", raw)
+		}
+		b = make([]byte, 8)
+		binary.BigEndian.PutUint64(b, uint64(raw))
+	case "FLOAT64":
+		b = make([]byte, 8)
+		binary.BigEndian.PutUint64(b, math.Float64bits(raw))
+	default:
+		return nil, fmt.Errorf("unsupported data_type %q", dataType)
 	}
 
-	handler.FuncWriteSingleCoil = func(address uint16, value uint16) (bool, error) {
-		m.mu.Lock()
-		defer m.mu.Unlock()
-		m.coils[address] = (value == 0xFF00)
-		return true, nil
+	registers := len(b) / 2
+	words := make([]uint16, registers)
+	for i := 0; i < registers; i++ {
+		hi, lo := b[i*2], b[i*2+1]
+		if byteOrder == "DCBA" || byteOrder == "BADC" {
+			hi, lo = lo, hi
+		}
+		words[i] = uint16(hi)<<8 | uint16(lo)
 	}
-
-	handler.FuncWriteSingleRegister = func(address uint16, value uint16) (bool, error) {
-		m.mu.Lock()
-		defer m.mu.Unlock()
-		m.holdingRegisters[address] = value
-		return true, nil
+	if byteOrder == "DCBA" || byteOrder == "CDAB" {
+		for i, j := 0, len(words)-1; i < j; i, j = i+1, j-1 {
+			words[i], words[j] = words[j], words[i]
+		}
 	}
+	return words, nil
+}
 
-	handler.Serve(conn)
+// toFloat64 normalizes the numeric field types Telegraf metrics carry.
+func toFloat64(v interface{}) (float64, bool) {
+	switch value := v.(type) {
+	case float64:
+		return value, true
+	case float32:
+		return float64(value), true
+	case int64:
+		return float64(value), true
+	case int:
+		return float64(value), true
+	case uint64:
+		return float64(value), true
+	case bool:
+		if value {
+			return 1, true
+		}
+		return 0, true
+	default:
+		return 0, false
+	}
 }
 
 func init() {
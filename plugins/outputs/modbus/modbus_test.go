@@ -0,0 +1,165 @@
+package modbus
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckQuantityBoundsAllowsLastAddress(t *testing.T) {
+	require.NoError(t, checkQuantityBounds(0xFFFF, 1, maxReadRegisters))
+}
+
+func TestCheckQuantityBoundsRejectsOverflow(t *testing.T) {
+	err := checkQuantityBounds(0xFFFF, 2, maxReadRegisters)
+	require.Error(t, err)
+}
+
+func TestEncodeRegistersByteOrder(t *testing.T) {
+	tests := []struct {
+		name      string
+		dataType  string
+		byteOrder string
+		raw       float64
+		want      []uint16
+	}{
+		{"uint32 ABCD", "UINT32", "ABCD", 0x11223344, []uint16{0x1122, 0x3344}},
+		{"uint32 DCBA", "UINT32", "DCBA", 0x11223344, []uint16{0x4433, 0x2211}},
+		{"uint32 BADC", "UINT32", "BADC", 0x11223344, []uint16{0x2211, 0x4433}},
+		{"uint32 CDAB", "UINT32", "CDAB", 0x11223344, []uint16{0x3344, 0x1122}},
+		{"uint64 ABCD", "UINT64", "ABCD", 0x1122334455667788, []uint16{0x1122, 0x3344, 0x5566, 0x7788}},
+		{"uint64 DCBA", "UINT64", "DCBA", 0x1122334455667788, []uint16{0x8877, 0x6655, 0x4433, 0x2211}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := encodeRegisters(tt.raw, tt.dataType, tt.byteOrder)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestEncodeRegistersFloat32(t *testing.T) {
+	words, err := encodeRegisters(1234.5, "FLOAT32", "ABCD")
+	require.NoError(t, err)
+	require.Len(t, words, 2)
+
+	// ABCD is plain big-endian: high 16 bits first, then low 16 bits.
+	bits := uint32(words[0])<<16 | uint32(words[1])
+	require.InDelta(t, 1234.5, float64(math.Float32frombits(bits)), 0.001)
+}
+
+func TestEncodeRegistersOverflow(t *testing.T) {
+	tests := []struct {
+		name     string
+		dataType string
+		raw      float64
+	}{
+		{"int16 overflow high", "INT16", 1 << 20},
+		{"uint16 negative", "UINT16", -1},
+		{"int32 overflow high", "INT32", 1 << 40},
+		{"uint32 negative", "UINT32", -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := encodeRegisters(tt.raw, tt.dataType, "ABCD")
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestEncodeRegistersUnknownDataType(t *testing.T) {
+	_, err := encodeRegisters(1, "BOGUS", "ABCD")
+	require.Error(t, err)
+}
+
+func TestBuildFieldMappingsRejectsOverlap(t *testing.T) {
+	m := &Modbus{
+		Mappings: []RegisterMapping{
+			{Metric: "power", Field: "voltage", RegisterType: registerTypeHoldingRegister, Address: 0, DataType: "FLOAT32"},
+			{Metric: "power", Field: "current", RegisterType: registerTypeHoldingRegister, Address: 1, DataType: "UINT16"},
+		},
+	}
+
+	err := m.buildFieldMappings()
+	require.Error(t, err)
+}
+
+func TestBuildFieldMappingsAcceptsAdjacentRanges(t *testing.T) {
+	m := &Modbus{
+		Mappings: []RegisterMapping{
+			{Metric: "power", Field: "voltage", RegisterType: registerTypeHoldingRegister, Address: 0, DataType: "FLOAT32"},
+			{Metric: "power", Field: "current", RegisterType: registerTypeHoldingRegister, Address: 2, DataType: "UINT16"},
+		},
+	}
+
+	require.NoError(t, m.buildFieldMappings())
+	require.Len(t, m.fieldMappings, 2)
+}
+
+func TestBuildFieldMappingsRejectsUnknownTypes(t *testing.T) {
+	tests := []struct {
+		name    string
+		mapping RegisterMapping
+	}{
+		{
+			name:    "unknown data_type",
+			mapping: RegisterMapping{Metric: "m", Field: "f", RegisterType: registerTypeHoldingRegister, DataType: "NOPE"},
+		},
+		{
+			name:    "unknown register_type",
+			mapping: RegisterMapping{Metric: "m", Field: "f", RegisterType: "bogus", DataType: "UINT16"},
+		},
+		{
+			name:    "bool on holding_register",
+			mapping: RegisterMapping{Metric: "m", Field: "f", RegisterType: registerTypeHoldingRegister, DataType: "BOOL"},
+		},
+		{
+			name:    "non-bool on coil",
+			mapping: RegisterMapping{Metric: "m", Field: "f", RegisterType: registerTypeCoil, DataType: "UINT16"},
+		},
+		{
+			name:    "unknown byte_order",
+			mapping: RegisterMapping{Metric: "m", Field: "f", RegisterType: registerTypeHoldingRegister, DataType: "FLOAT32", ByteOrder: "WXYZ"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &Modbus{Mappings: []RegisterMapping{tt.mapping}}
+			require.Error(t, m.buildFieldMappings())
+		})
+	}
+}
+
+func TestPackBits(t *testing.T) {
+	tests := []struct {
+		name     string
+		bits     []bool
+		wantLen  int
+		wantByte byte
+	}{
+		{"empty", nil, 0, 0},
+		{"one bit", []bool{true}, 1, 0x01},
+		{"exactly one byte", []bool{true, false, false, false, false, false, false, true}, 1, 0x81},
+		{"spills into second byte", []bool{true, false, false, false, false, false, false, false, true}, 2, 0x01},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := packBits(tt.bits)
+			require.Len(t, got, tt.wantLen)
+			if tt.wantLen > 0 {
+				require.Equal(t, tt.wantByte, got[0])
+			}
+		})
+	}
+}
+
+func TestPackRegisters(t *testing.T) {
+	got := packRegisters([]uint16{0x1234, 0xABCD})
+	require.Equal(t, []byte{0x12, 0x34, 0xAB, 0xCD}, got)
+}
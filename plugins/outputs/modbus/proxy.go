@@ -0,0 +1,265 @@
+package modbus
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goburrow/modbus"
+	"github.com/influxdata/telegraf/config"
+)
+
+// clientHandler is the subset of goburrow/modbus's TCPClientHandler and
+// RTUClientHandler that Upstream needs to manage the connection lifecycle.
+type clientHandler interface {
+	Connect() error
+	Close() error
+}
+
+// AddressRange restricts an Upstream to a slice of a register type's address
+// space. When Upstream.AddressRange is empty the upstream is considered a
+// catch-all for any address within its unit.
+type AddressRange struct {
+	RegisterType string `toml:"register_type"`
+	Start        uint16 `toml:"start"`
+	End          uint16 `toml:"end"`
+}
+
+func (r AddressRange) contains(registerType string, address uint16) bool {
+	return r.RegisterType == registerType && address >= r.Start && address < r.End
+}
+
+// Upstream is a real Modbus device this output proxies selected function
+// codes to, in addition to serving from its own in-memory maps.
+type Upstream struct {
+	UnitID       byte            `toml:"unit_id"`
+	Address      string          `toml:"address"`
+	Timeout      config.Duration `toml:"timeout"`
+	AddressRange []AddressRange  `toml:"address_range"`
+
+	mu        sync.Mutex // serializes requests to this upstream, required for RTU
+	handler   clientHandler
+	client    modbus.Client
+	connected bool
+	nextRetry time.Time
+	backoff   time.Duration
+}
+
+const (
+	upstreamMinBackoff = 500 * time.Millisecond
+	upstreamMaxBackoff = 30 * time.Second
+)
+
+// matches reports whether this upstream should handle a request for
+// registerType/address. With no configured ranges, the upstream matches
+// everything it's given.
+func (u *Upstream) matches(registerType string, address uint16) bool {
+	if len(u.AddressRange) == 0 {
+		return true
+	}
+	for _, r := range u.AddressRange {
+		if r.contains(registerType, address) {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *Upstream) isSerial() bool {
+	return strings.HasPrefix(u.Address, "/dev/") || strings.HasPrefix(u.Address, "COM")
+}
+
+// ensureConnected (re)connects the upstream client, backing off between
+// failed attempts so a dead device doesn't get hammered on every request.
+func (u *Upstream) ensureConnected() error {
+	if u.connected {
+		return nil
+	}
+	if time.Now().Before(u.nextRetry) {
+		return fmt.Errorf("upstream %s: waiting for reconnect backoff", u.Address)
+	}
+
+	timeout := time.Duration(u.Timeout)
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+
+	if u.handler == nil {
+		if u.isSerial() {
+			h := modbus.NewRTUClientHandler(u.Address)
+			h.SlaveId = u.UnitID
+			h.Timeout = timeout
+			u.handler = h
+			u.client = modbus.NewClient(h)
+		} else {
+			h := modbus.NewTCPClientHandler(u.Address)
+			h.SlaveId = u.UnitID
+			h.Timeout = timeout
+			u.handler = h
+			u.client = modbus.NewClient(h)
+		}
+	}
+
+	if err := u.handler.Connect(); err != nil {
+		if u.backoff == 0 {
+			u.backoff = upstreamMinBackoff
+		} else {
+			u.backoff *= 2
+			if u.backoff > upstreamMaxBackoff {
+				u.backoff = upstreamMaxBackoff
+			}
+		}
+		u.nextRetry = time.Now().Add(u.backoff)
+		return fmt.Errorf("upstream %s: connect failed: %w", u.Address, err)
+	}
+
+	u.connected = true
+	u.backoff = 0
+	return nil
+}
+
+func (u *Upstream) disconnect() {
+	if u.handler != nil {
+		u.handler.Close()
+	}
+	u.connected = false
+}
+
+// proxyCacheEntry holds a short-lived copy of an upstream read so that
+// several near-simultaneous client requests don't each round-trip to the
+// same device.
+type proxyCacheEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+func cacheKey(upstream *Upstream, registerType string, address, quantity uint16) string {
+	return fmt.Sprintf("%s|%d|%s|%d|%d", upstream.Address, upstream.UnitID, registerType, address, quantity)
+}
+
+// proxyRead forwards a read to the matching upstream, serving a cached
+// result when one is fresh enough.
+func (m *Modbus) proxyRead(upstream *Upstream, registerType string, address, quantity uint16) ([]byte, error) {
+	key := cacheKey(upstream, registerType, address, quantity)
+
+	m.proxyCacheMu.Lock()
+	if entry, ok := m.proxyCache[key]; ok && time.Now().Before(entry.expires) {
+		m.proxyCacheMu.Unlock()
+		return entry.value, nil
+	}
+	m.proxyCacheMu.Unlock()
+
+	upstream.mu.Lock()
+	defer upstream.mu.Unlock()
+
+	if err := upstream.ensureConnected(); err != nil {
+		return nil, translateUpstreamError(err)
+	}
+
+	var (
+		result []byte
+		err    error
+	)
+	switch registerType {
+	case registerTypeCoil:
+		result, err = upstream.client.ReadCoils(address, quantity)
+	case registerTypeDiscreteInput:
+		result, err = upstream.client.ReadDiscreteInputs(address, quantity)
+	case registerTypeInputRegister:
+		result, err = upstream.client.ReadInputRegisters(address, quantity)
+	case registerTypeHoldingRegister:
+		result, err = upstream.client.ReadHoldingRegisters(address, quantity)
+	default:
+		return nil, fmt.Errorf("upstream %s: unsupported register_type %q", upstream.Address, registerType)
+	}
+	if err != nil {
+		upstream.disconnect()
+		return nil, translateUpstreamError(err)
+	}
+
+	ttl := time.Duration(m.ProxyCacheTTL)
+	if ttl <= 0 {
+		ttl = 250 * time.Millisecond
+	}
+	m.proxyCacheMu.Lock()
+	m.proxyCache[key] = proxyCacheEntry{value: result, expires: time.Now().Add(ttl)}
+	m.proxyCacheMu.Unlock()
+
+	return result, nil
+}
+
+// proxyWriteSingle forwards a single coil/register write to the matching
+// upstream. On success the caller mirrors the value into the local map.
+func (m *Modbus) proxyWriteSingle(upstream *Upstream, registerType string, address, value uint16) error {
+	upstream.mu.Lock()
+	defer upstream.mu.Unlock()
+
+	if err := upstream.ensureConnected(); err != nil {
+		return translateUpstreamError(err)
+	}
+
+	var err error
+	switch registerType {
+	case registerTypeCoil:
+		_, err = upstream.client.WriteSingleCoil(address, value)
+	case registerTypeHoldingRegister:
+		_, err = upstream.client.WriteSingleRegister(address, value)
+	default:
+		return fmt.Errorf("upstream %s: register_type %q is not writable", upstream.Address, registerType)
+	}
+	if err != nil {
+		upstream.disconnect()
+		return translateUpstreamError(err)
+	}
+	return nil
+}
+
+// proxyWriteMultiple forwards an FC15/FC16 block write to the matching
+// upstream. On success the caller mirrors the values into the local map.
+func (m *Modbus) proxyWriteMultiple(upstream *Upstream, registerType string, address, quantity uint16, values []byte) error {
+	upstream.mu.Lock()
+	defer upstream.mu.Unlock()
+
+	if err := upstream.ensureConnected(); err != nil {
+		return translateUpstreamError(err)
+	}
+
+	var err error
+	switch registerType {
+	case registerTypeCoil:
+		_, err = upstream.client.WriteMultipleCoils(address, quantity, values)
+	case registerTypeHoldingRegister:
+		_, err = upstream.client.WriteMultipleRegisters(address, quantity, values)
+	default:
+		return fmt.Errorf("upstream %s: register_type %q is not writable", upstream.Address, registerType)
+	}
+	if err != nil {
+		upstream.disconnect()
+		return translateUpstreamError(err)
+	}
+	return nil
+}
+
+// upstreamFor returns the first configured upstream willing to handle
+// registerType/address, or nil if none matches and the request should be
+// served from the local in-memory map.
+func (m *Modbus) upstreamFor(registerType string, address uint16) *Upstream {
+	for _, u := range m.Upstreams {
+		if u.matches(registerType, address) {
+			return u
+		}
+	}
+	return nil
+}
+
+// translateUpstreamError passes Modbus exception responses from the
+// upstream straight through to our client, since goburrow/modbus already
+// represents them the way the server handler expects; anything else (a
+// dropped connection, a timeout) is reported as a server device failure.
+func translateUpstreamError(err error) error {
+	if _, ok := err.(*modbus.ModbusError); ok {
+		return err
+	}
+	return &modbus.ModbusError{ExceptionCode: modbus.ExceptionCodeServerDeviceFailure}
+}
@@ -0,0 +1,434 @@
+package modbus
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+
+	"github.com/goburrow/modbus"
+	tlsint "github.com/influxdata/telegraf/plugins/common/tls"
+)
+
+// Supported transport values.
+const (
+	transportTCP    = "tcp"
+	transportTCPTLS = "tcp+tls"
+	transportRTU    = "rtu"
+)
+
+// Per-transaction quantity ceilings from the Modbus application protocol
+// spec, enforced by real clients such as goburrow/modbus. A client wanting
+// a bigger block issues several back-to-back requests instead. Reads and
+// writes have distinct ceilings for the same function group: the write
+// PDU reserves part of its byte budget for the byte-count field, so it
+// fits fewer coils/registers than the equivalent read.
+const (
+	maxReadCoils      = 2000
+	maxReadRegisters  = 125
+	maxWriteCoils     = 1968
+	maxWriteRegisters = 123
+)
+
+// checkQuantityBounds validates a read or write request against the spec's
+// per-function quantity ceiling and the 16-bit address space, returning the
+// matching Modbus exception when either is violated.
+func checkQuantityBounds(address, quantity uint16, maxQuantity int) error {
+	if int(quantity) > maxQuantity {
+		return &modbus.ModbusError{ExceptionCode: modbus.ExceptionCodeIllegalDataValue}
+	}
+	if uint32(address)+uint32(quantity) > 0x10000 {
+		return &modbus.ModbusError{ExceptionCode: modbus.ExceptionCodeIllegalDataAddress}
+	}
+	return nil
+}
+
+// serverHandler is the set of Func* callbacks every transport-specific
+// handler (TCP, TCP+TLS, RTU) exposes. installHandlers wires the same
+// coil/register logic onto whichever concrete handler type the configured
+// transport hands back, so the callbacks themselves stay transport-agnostic.
+type serverHandler interface {
+	slaveID() byte
+	setFuncReadCoils(func(address, quantity uint16) ([]byte, error))
+	setFuncReadDiscreteInputs(func(address, quantity uint16) ([]byte, error))
+	setFuncReadHoldingRegisters(func(address, quantity uint16) ([]byte, error))
+	setFuncReadInputRegisters(func(address, quantity uint16) ([]byte, error))
+	setFuncWriteSingleCoil(func(address, value uint16) (bool, error))
+	setFuncWriteSingleRegister(func(address, value uint16) (bool, error))
+	setFuncWriteMultipleCoils(func(address, quantity uint16, values []byte) (uint16, error))
+	setFuncWriteMultipleRegisters(func(address, quantity uint16, values []byte) (uint16, error))
+}
+
+// tcpServerHandler adapts *modbus.TCPHandler (used for both plain TCP and
+// TCP-over-TLS, since TLS only changes how the listener is wrapped) to
+// serverHandler.
+type tcpServerHandler struct{ *modbus.TCPHandler }
+
+func (h tcpServerHandler) slaveID() byte { return h.SlaveId }
+func (h tcpServerHandler) setFuncReadCoils(f func(uint16, uint16) ([]byte, error)) {
+	h.FuncReadCoils = f
+}
+func (h tcpServerHandler) setFuncReadDiscreteInputs(f func(uint16, uint16) ([]byte, error)) {
+	h.FuncReadDiscreteInputs = f
+}
+func (h tcpServerHandler) setFuncReadHoldingRegisters(f func(uint16, uint16) ([]byte, error)) {
+	h.FuncReadHoldingRegisters = f
+}
+func (h tcpServerHandler) setFuncReadInputRegisters(f func(uint16, uint16) ([]byte, error)) {
+	h.FuncReadInputRegisters = f
+}
+func (h tcpServerHandler) setFuncWriteSingleCoil(f func(uint16, uint16) (bool, error)) {
+	h.FuncWriteSingleCoil = f
+}
+func (h tcpServerHandler) setFuncWriteSingleRegister(f func(uint16, uint16) (bool, error)) {
+	h.FuncWriteSingleRegister = f
+}
+func (h tcpServerHandler) setFuncWriteMultipleCoils(f func(uint16, uint16, []byte) (uint16, error)) {
+	h.FuncWriteMultipleCoils = f
+}
+func (h tcpServerHandler) setFuncWriteMultipleRegisters(f func(uint16, uint16, []byte) (uint16, error)) {
+	h.FuncWriteMultipleRegisters = f
+}
+
+// rtuServerHandler adapts *modbus.RTUHandler to serverHandler.
+type rtuServerHandler struct{ *modbus.RTUHandler }
+
+func (h rtuServerHandler) slaveID() byte { return h.SlaveId }
+func (h rtuServerHandler) setFuncReadCoils(f func(uint16, uint16) ([]byte, error)) {
+	h.FuncReadCoils = f
+}
+func (h rtuServerHandler) setFuncReadDiscreteInputs(f func(uint16, uint16) ([]byte, error)) {
+	h.FuncReadDiscreteInputs = f
+}
+func (h rtuServerHandler) setFuncReadHoldingRegisters(f func(uint16, uint16) ([]byte, error)) {
+	h.FuncReadHoldingRegisters = f
+}
+func (h rtuServerHandler) setFuncReadInputRegisters(f func(uint16, uint16) ([]byte, error)) {
+	h.FuncReadInputRegisters = f
+}
+func (h rtuServerHandler) setFuncWriteSingleCoil(f func(uint16, uint16) (bool, error)) {
+	h.FuncWriteSingleCoil = f
+}
+func (h rtuServerHandler) setFuncWriteSingleRegister(f func(uint16, uint16) (bool, error)) {
+	h.FuncWriteSingleRegister = f
+}
+func (h rtuServerHandler) setFuncWriteMultipleCoils(f func(uint16, uint16, []byte) (uint16, error)) {
+	h.FuncWriteMultipleCoils = f
+}
+func (h rtuServerHandler) setFuncWriteMultipleRegisters(f func(uint16, uint16, []byte) (uint16, error)) {
+	h.FuncWriteMultipleRegisters = f
+}
+
+// installHandlers attaches the coil/register callbacks to handler, whatever
+// the underlying transport. Each callback checks handler.slaveID() against
+// m.UnitID itself (rather than relying on the transport to filter) so that a
+// request addressed to another slave gets an illegal-address exception
+// instead of silently reading/writing the shared map.
+func (m *Modbus) installHandlers(handler serverHandler) {
+	handler.setFuncReadCoils(m.handleReadCoils(handler))
+	handler.setFuncReadDiscreteInputs(m.handleReadDiscreteInputs(handler))
+	handler.setFuncReadHoldingRegisters(m.handleReadHoldingRegisters(handler))
+	handler.setFuncReadInputRegisters(m.handleReadInputRegisters(handler))
+	handler.setFuncWriteSingleCoil(m.handleWriteSingleCoil(handler))
+	handler.setFuncWriteSingleRegister(m.handleWriteSingleRegister(handler))
+	handler.setFuncWriteMultipleCoils(m.handleWriteMultipleCoils(handler))
+	handler.setFuncWriteMultipleRegisters(m.handleWriteMultipleRegisters(handler))
+}
+
+// checkUnitID returns an illegal-data-address exception when the request's
+// unit ID doesn't match the configured one. UnitID of 0 means "respond to
+// any unit", matching the plugin's historical single-map behavior.
+func (m *Modbus) checkUnitID(handler serverHandler) error {
+	if m.UnitID != 0 && handler.slaveID() != m.UnitID {
+		return &modbus.ModbusError{ExceptionCode: modbus.ExceptionCodeIllegalDataAddress}
+	}
+	return nil
+}
+
+func (m *Modbus) handleReadCoils(handler serverHandler) func(uint16, uint16) ([]byte, error) {
+	return func(address, quantity uint16) ([]byte, error) {
+		if err := m.checkUnitID(handler); err != nil {
+			return nil, err
+		}
+		if err := checkQuantityBounds(address, quantity, maxReadCoils); err != nil {
+			return nil, err
+		}
+		if upstream := m.upstreamFor(registerTypeCoil, address); upstream != nil {
+			return m.proxyRead(upstream, registerTypeCoil, address, quantity)
+		}
+		m.mu.Lock()
+		bits := make([]bool, quantity)
+		for i := uint16(0); i < quantity; i++ {
+			bits[i] = m.coils[address+i]
+		}
+		m.mu.Unlock()
+		return packBits(bits), nil
+	}
+}
+
+func (m *Modbus) handleReadDiscreteInputs(handler serverHandler) func(uint16, uint16) ([]byte, error) {
+	return func(address, quantity uint16) ([]byte, error) {
+		if err := m.checkUnitID(handler); err != nil {
+			return nil, err
+		}
+		if err := checkQuantityBounds(address, quantity, maxReadCoils); err != nil {
+			return nil, err
+		}
+		if upstream := m.upstreamFor(registerTypeDiscreteInput, address); upstream != nil {
+			return m.proxyRead(upstream, registerTypeDiscreteInput, address, quantity)
+		}
+		m.mu.Lock()
+		bits := make([]bool, quantity)
+		for i := uint16(0); i < quantity; i++ {
+			bits[i] = m.discreteInputs[address+i]
+		}
+		m.mu.Unlock()
+		return packBits(bits), nil
+	}
+}
+
+func (m *Modbus) handleReadHoldingRegisters(handler serverHandler) func(uint16, uint16) ([]byte, error) {
+	return func(address, quantity uint16) ([]byte, error) {
+		if err := m.checkUnitID(handler); err != nil {
+			return nil, err
+		}
+		if err := checkQuantityBounds(address, quantity, maxReadRegisters); err != nil {
+			return nil, err
+		}
+		if upstream := m.upstreamFor(registerTypeHoldingRegister, address); upstream != nil {
+			return m.proxyRead(upstream, registerTypeHoldingRegister, address, quantity)
+		}
+		m.mu.Lock()
+		words := make([]uint16, quantity)
+		for i := uint16(0); i < quantity; i++ {
+			words[i] = m.holdingRegisters[address+i]
+		}
+		m.mu.Unlock()
+		return packRegisters(words), nil
+	}
+}
+
+func (m *Modbus) handleReadInputRegisters(handler serverHandler) func(uint16, uint16) ([]byte, error) {
+	return func(address, quantity uint16) ([]byte, error) {
+		if err := m.checkUnitID(handler); err != nil {
+			return nil, err
+		}
+		if err := checkQuantityBounds(address, quantity, maxReadRegisters); err != nil {
+			return nil, err
+		}
+		if upstream := m.upstreamFor(registerTypeInputRegister, address); upstream != nil {
+			return m.proxyRead(upstream, registerTypeInputRegister, address, quantity)
+		}
+		m.mu.Lock()
+		words := make([]uint16, quantity)
+		for i := uint16(0); i < quantity; i++ {
+			words[i] = m.inputRegisters[address+i]
+		}
+		m.mu.Unlock()
+		return packRegisters(words), nil
+	}
+}
+
+// packBits serializes coil/discrete-input values into the Modbus wire
+// format: one bit per value, LSB first, packed (quantity+7)/8 bytes.
+func packBits(bits []bool) []byte {
+	result := make([]byte, (len(bits)+7)/8)
+	for i, set := range bits {
+		if set {
+			result[i/8] |= 1 << (uint(i) % 8)
+		}
+	}
+	return result
+}
+
+// packRegisters serializes register values into the Modbus wire format:
+// two big-endian bytes per register.
+func packRegisters(words []uint16) []byte {
+	result := make([]byte, len(words)*2)
+	for i, word := range words {
+		modbus.Uint16ToBytes(word, result[i*2:])
+	}
+	return result
+}
+
+func (m *Modbus) handleWriteSingleCoil(handler serverHandler) func(uint16, uint16) (bool, error) {
+	return func(address, value uint16) (bool, error) {
+		if err := m.checkUnitID(handler); err != nil {
+			return false, err
+		}
+		if upstream := m.upstreamFor(registerTypeCoil, address); upstream != nil {
+			if err := m.proxyWriteSingle(upstream, registerTypeCoil, address, value); err != nil {
+				return false, err
+			}
+		}
+		set := value == 0xFF00
+		m.mu.Lock()
+		m.coils[address] = set
+		m.mu.Unlock()
+		m.notifyWrite(registerTypeCoil, address, []uint16{value})
+		return true, nil
+	}
+}
+
+func (m *Modbus) handleWriteSingleRegister(handler serverHandler) func(uint16, uint16) (bool, error) {
+	return func(address, value uint16) (bool, error) {
+		if err := m.checkUnitID(handler); err != nil {
+			return false, err
+		}
+		if upstream := m.upstreamFor(registerTypeHoldingRegister, address); upstream != nil {
+			if err := m.proxyWriteSingle(upstream, registerTypeHoldingRegister, address, value); err != nil {
+				return false, err
+			}
+		}
+		m.mu.Lock()
+		m.holdingRegisters[address] = value
+		m.mu.Unlock()
+		m.notifyWrite(registerTypeHoldingRegister, address, []uint16{value})
+		return true, nil
+	}
+}
+
+// handleWriteMultipleCoils implements FC15, allowing an external client to
+// push a whole block of coils in one request.
+func (m *Modbus) handleWriteMultipleCoils(handler serverHandler) func(uint16, uint16, []byte) (uint16, error) {
+	return func(address, quantity uint16, values []byte) (uint16, error) {
+		if err := m.checkUnitID(handler); err != nil {
+			return 0, err
+		}
+		if err := checkQuantityBounds(address, quantity, maxWriteCoils); err != nil {
+			return 0, err
+		}
+		if len(values) < int(quantity+7)/8 {
+			return 0, &modbus.ModbusError{ExceptionCode: modbus.ExceptionCodeIllegalDataValue}
+		}
+		if upstream := m.upstreamFor(registerTypeCoil, address); upstream != nil {
+			if err := m.proxyWriteMultiple(upstream, registerTypeCoil, address, quantity, values); err != nil {
+				return 0, err
+			}
+		}
+
+		written := make([]uint16, quantity)
+		m.mu.Lock()
+		for i := uint16(0); i < quantity; i++ {
+			set := values[i/8]&(1<<(i%8)) != 0
+			m.coils[address+i] = set
+			if set {
+				written[i] = 1
+			}
+		}
+		m.mu.Unlock()
+		m.notifyWrite(registerTypeCoil, address, written)
+		return quantity, nil
+	}
+}
+
+// handleWriteMultipleRegisters implements FC16, allowing an external client
+// to push a whole block of holding registers in one request.
+func (m *Modbus) handleWriteMultipleRegisters(handler serverHandler) func(uint16, uint16, []byte) (uint16, error) {
+	return func(address, quantity uint16, values []byte) (uint16, error) {
+		if err := m.checkUnitID(handler); err != nil {
+			return 0, err
+		}
+		if err := checkQuantityBounds(address, quantity, maxWriteRegisters); err != nil {
+			return 0, err
+		}
+		if len(values) < int(quantity)*2 {
+			return 0, &modbus.ModbusError{ExceptionCode: modbus.ExceptionCodeIllegalDataValue}
+		}
+		if upstream := m.upstreamFor(registerTypeHoldingRegister, address); upstream != nil {
+			if err := m.proxyWriteMultiple(upstream, registerTypeHoldingRegister, address, quantity, values); err != nil {
+				return 0, err
+			}
+		}
+
+		words := make([]uint16, quantity)
+		m.mu.Lock()
+		for i := uint16(0); i < quantity; i++ {
+			word := uint16(values[i*2])<<8 | uint16(values[i*2+1])
+			m.holdingRegisters[address+i] = word
+			words[i] = word
+		}
+		m.mu.Unlock()
+		m.notifyWrite(registerTypeHoldingRegister, address, words)
+		return quantity, nil
+	}
+}
+
+// notifyWrite reports a client-originated write to OnWrite, if configured,
+// so a downstream processor/aggregator or companion input plugin can turn
+// SCADA-initiated writes into Telegraf metrics of their own.
+func (m *Modbus) notifyWrite(registerType string, address uint16, values []uint16) {
+	if m.OnWrite != nil {
+		m.OnWrite(registerType, address, values)
+	}
+}
+
+// StartServer opens the configured transport and serves Modbus requests.
+// For tcp and tcp+tls the accept loop does not return: an Accept error,
+// including one from a closed listener, is logged and the loop accepts
+// again. For rtu it returns when the serial handler's Serve returns.
+func (m *Modbus) StartServer() {
+	switch m.Transport {
+	case "", transportTCP:
+		m.startTCPServer(false)
+	case transportTCPTLS:
+		m.startTCPServer(true)
+	case transportRTU:
+		m.startRTUServer()
+	default:
+		fmt.Println("Error starting Modbus server: unknown transport", m.Transport)
+	}
+}
+
+func (m *Modbus) startTCPServer(useTLS bool) {
+	var listener net.Listener
+	listener, err := net.Listen("tcp", m.Address)
+	if err != nil {
+		fmt.Println("Error starting Modbus server:", err)
+		return
+	}
+	defer listener.Close()
+
+	if useTLS {
+		tlsConfig, err := m.ServerConfig.TLSConfig()
+		if err != nil {
+			fmt.Println("Error building Modbus TLS config:", err)
+			return
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	handler := modbus.NewTCPServerHandler(listener)
+	m.server = modbus.NewServer(handler)
+	fmt.Println("Modbus server listening on", m.Address)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			fmt.Println("Error accepting connection:", err)
+			continue
+		}
+		go m.serveConn(conn)
+	}
+}
+
+func (m *Modbus) serveConn(conn net.Conn) {
+	handler := modbus.NewTCPHandler()
+	m.installHandlers(tcpServerHandler{handler})
+	handler.Serve(conn)
+}
+
+func (m *Modbus) startRTUServer() {
+	handler := modbus.NewRTUHandler(m.SerialDevice)
+	handler.BaudRate = m.BaudRate
+	handler.DataBits = m.DataBits
+	handler.Parity = m.Parity
+	handler.StopBits = m.StopBits
+	m.rtuHandler = handler
+
+	m.installHandlers(rtuServerHandler{handler})
+
+	fmt.Println("Modbus RTU server listening on", m.SerialDevice)
+	if err := handler.Serve(); err != nil {
+		fmt.Println("Error serving Modbus RTU:", err)
+	}
+}